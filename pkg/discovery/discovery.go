@@ -0,0 +1,523 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery implements the discovery service that PD pods call
+// into via their `--join`/`--initial-cluster` bootstrap hooks. Each PD pod
+// registers itself with its advertise-peer-url and the service tells it
+// either to wait, to bootstrap a new quorum, or to join one that already
+// exists.
+package discovery
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tidb-operator/pkg/discovery/types"
+	"github.com/pingcap/tidb-operator/pkg/pdapi"
+	"k8s.io/klog"
+)
+
+const (
+	// pdPeerPort is the port PD members advertise to each other for Raft traffic.
+	pdPeerPort = "2380"
+	// pdClientPort is the port PD members serve client/etcd API traffic on.
+	pdClientPort = "2379"
+
+	// pdElectionTimeout mirrors PD's own default Raft election timeout.
+	pdElectionTimeout = 3 * time.Second
+	// defaultPeerTTL is how long a registered peer may go unrefreshed
+	// before the sweeper drops it, in the absence of an explicit expireAt.
+	defaultPeerTTL = 2 * pdElectionTimeout
+)
+
+// PDName, Cluster and PeerCluster live in pkg/discovery/types so that
+// pdapi and external tools can depend on them without importing the
+// discovery server itself.
+type (
+	PDName      = types.PDName
+	Cluster     = types.Cluster
+	PeerCluster = types.PeerCluster
+)
+
+// clusterInfo tracks the PD pods that have registered for a given cluster
+// between calls to Discover.
+type clusterInfo struct {
+	resourceVersion string
+	peers           map[PDName]*peerInfo
+}
+
+// peerInfo is what the discovery service knows about one registered PD
+// peer: its advertise-peer URL, the PD member ID once it's been learned
+// from pdapi.MembersInfo, and enough bookkeeping for the sweeper to expire
+// it. memberID is checked against PD's membership report on every refresh
+// (see updateMemberIDs): a mismatch means a PD pod was recreated under the
+// same name but with a different identity, and its stale registration is
+// dropped rather than refreshed.
+type peerInfo struct {
+	url      url.URL
+	memberID uint64
+	lastSeen time.Time
+	// expireAt is an explicit expiry set by the caller; the zero value
+	// means the peer only expires via the TTL sweep.
+	expireAt time.Time
+}
+
+// expired reports whether a peer should be dropped by the sweeper: either
+// its explicit expireAt has passed, or it hasn't refreshed within ttl.
+func (p *peerInfo) expired(now time.Time, ttl time.Duration) bool {
+	if !p.expireAt.IsZero() && now.After(p.expireAt) {
+		return true
+	}
+	return now.Sub(p.lastSeen) > ttl
+}
+
+// refresher loads the live state Discover needs in order to make a
+// decision: the TidbCluster spec (as a Cluster) and, once a quorum may
+// already exist, the PD members reported by that quorum.
+type refresher interface {
+	GetCluster(clusterID string) (Cluster, error)
+	GetMembers(clusterID string) (*pdapi.MembersInfo, error)
+}
+
+// peerDiscoverer proxies a Discover-style request to a peer cluster's
+// discovery service, returning the peer quorum's PD client URLs when one is
+// already established.
+type peerDiscoverer interface {
+	DiscoverPeerMembers(peer PeerCluster) ([]string, error)
+}
+
+// tidbDiscovery holds the bootstrap bookkeeping shared by all discovery
+// modes: PD pods grouped by "<namespace>/<tcName>" in clusters, and PD pods
+// rendezvousing via a shared discoveryToken in tokens.
+type tidbDiscovery struct {
+	lock     sync.Mutex
+	clusters map[string]*clusterInfo
+	tokens   map[string]*tokenInfo
+}
+
+// tidbDiscoveryMembers implements the original per-TidbCluster discovery
+// flow: PD pods are grouped by "<namespace>/<tcName>" and Discover tells
+// each one whether to wait, bootstrap, or join.
+type tidbDiscoveryMembers struct {
+	tidbDiscovery
+
+	refresh refresher
+	// peer may be nil; it is only consulted for clusters that have a
+	// PeerCluster configured.
+	peer peerDiscoverer
+}
+
+// NewTiDBDiscoveryMembers returns the default discovery implementation.
+func NewTiDBDiscoveryMembers(refresh refresher, peer peerDiscoverer) *tidbDiscoveryMembers {
+	return &tidbDiscoveryMembers{
+		tidbDiscovery: tidbDiscovery{
+			clusters: map[string]*clusterInfo{},
+			tokens:   map[string]*tokenInfo{},
+		},
+		refresh: refresh,
+		peer:    peer,
+	}
+}
+
+// ParseAddress parses a bare "host:port" or scheme-qualified address into a
+// *url.URL, defaulting to the http scheme when none is given.
+func ParseAddress(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return url.Parse(address)
+}
+
+// ParseK8sAddress parses a PD pod's advertise-peer-url of the form
+// "<podName>.<peerServiceName>.<namespace>.svc[.<peerClusterName>]:<port>"
+// into the identifiers Discover needs: the requesting PD's name, the
+// clusterID key ("<namespace>/<tcName>") and the parsed URL.
+//
+// A fifth label after "svc" names a peer TidbCluster reachable in a
+// different Kubernetes cluster (e.g. "...svc.peer1:2380"); such addresses
+// are accepted rather than rejected for not matching the plain 4-label
+// in-cluster form.
+func ParseK8sAddress(advertisePeerURL string) (PDName, string, *url.URL, error) {
+	parsedURL, err := ParseAddress(advertisePeerURL)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	parts := strings.Split(parsedURL.Hostname(), ".")
+	if len(parts) != 4 && len(parts) != 5 {
+		return "", "", nil, fmt.Errorf("advertisePeerURL format is wrong: %s", advertisePeerURL)
+	}
+
+	podName, peerServiceName, ns := parts[0], parts[1], parts[2]
+	if ns != os.Getenv("MY_POD_NAMESPACE") {
+		return "", "", nil, fmt.Errorf("namespace %s is not equal to discovery namespace: %s", ns, os.Getenv("MY_POD_NAMESPACE"))
+	}
+
+	tcName := strings.TrimSuffix(peerServiceName, "-pd-peer")
+	clusterID := fmt.Sprintf("%s/%s", ns, tcName)
+	return PDName(podName), clusterID, parsedURL, nil
+}
+
+// Discover tells a PD pod what to do next: wait for its peers to register,
+// bootstrap a new quorum, or join one that is already up - whether that
+// quorum lives locally or, when the cluster is configured with a
+// PeerCluster, in a peer Kubernetes cluster.
+func (td *tidbDiscoveryMembers) Discover(pdName PDName, clusterID string, peerURL *url.URL) (string, error) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	cluster, err := td.refresh.GetCluster(clusterID)
+	if err != nil {
+		return "", err
+	}
+
+	ci, ok := td.clusters[clusterID]
+	if !ok || ci.resourceVersion != cluster.ResourceVersion {
+		ci = &clusterInfo{
+			resourceVersion: cluster.ResourceVersion,
+			peers:           map[PDName]*peerInfo{},
+		}
+		td.clusters[clusterID] = ci
+	}
+
+	// A peer cluster is only consulted while the local quorum isn't yet
+	// complete. Once this pod's registration would bring the local peer
+	// count up to Replicas, the local quorum takes precedence over the
+	// peer's, so two PD pods can't each bootstrap their own quorum and
+	// split-brain. localCount accounts for this call's own pdName, whether
+	// or not it's registered yet.
+	localCount := len(ci.peers)
+	if _, alreadyRegistered := ci.peers[pdName]; !alreadyRegistered {
+		localCount++
+	}
+	if cluster.PeerCluster != nil && td.peer != nil && localCount < cluster.Replicas {
+		// This is a deliberate fail-closed tradeoff: a cluster configured
+		// with a PeerCluster is relying on the peer's quorum until its own
+		// local replicas catch up, and has no safe local fallback for that
+		// window - bootstrapping locally anyway is exactly the
+		// split-brain this branch exists to prevent. So for as long as
+		// localCount < Replicas, a transient error reaching the peer's
+		// discovery service blocks this pod's bootstrap rather than
+		// risking a second quorum forming unnoticed.
+		joinURLs, err := td.peer.DiscoverPeerMembers(*cluster.PeerCluster)
+		if err != nil {
+			return "", fmt.Errorf("discovery: peer cluster lookup for %s failed: %v", clusterID, err)
+		}
+		if len(joinURLs) > 0 {
+			return fmt.Sprintf("--join=%s", strings.Join(joinURLs, ",")), nil
+		}
+	}
+
+	if peer, registered := ci.peers[pdName]; !registered {
+		if len(ci.peers) == cluster.Replicas-1 {
+			// This is the last PD needed to form the initial quorum; it
+			// bootstraps with itself as the sole initial member and the
+			// others join once the quorum is up.
+			return fmt.Sprintf("--initial-cluster=%s=%s://%s", pdName, cluster.Scheme, peerURL.Host), nil
+		}
+		ci.peers[pdName] = &peerInfo{url: *peerURL, lastSeen: time.Now()}
+	} else {
+		peer.lastSeen = time.Now()
+	}
+
+	membersInfo, err := td.refresh.GetMembers(clusterID)
+	if err != nil {
+		return "", err
+	}
+	updateMemberIDs(ci.peers, membersInfo)
+
+	delete(ci.peers, pdName)
+	joinURLs := make([]string, 0, len(membersInfo.Members))
+	for _, member := range membersInfo.Members {
+		for _, peer := range member.PeerUrls {
+			joinURLs = append(joinURLs, peerToClientURL(peer))
+		}
+	}
+	return fmt.Sprintf("--join=%s", strings.Join(joinURLs, ",")), nil
+}
+
+// DiscoverTLS is Discover's mTLS-authenticated entry point, used by the
+// discovery HTTP handler when it terminates TLS itself: peerCerts is the
+// client certificate chain the calling pod presented on the connection.
+// When the cluster sets RequireClientCert, the chain is verified before
+// Discover runs (see verifyPeerCertificate): against the cluster's own
+// TrustBundle and, when a PeerCluster is configured, also against that
+// PeerCluster's PeerTrustBundle. A PeerCluster adds an accepted issuer; it
+// never stops the cluster's own TrustBundle from being accepted.
+func (td *tidbDiscoveryMembers) DiscoverTLS(pdName PDName, clusterID string, peerURL *url.URL, peerCerts []*x509.Certificate) (string, error) {
+	cluster, err := td.refresh.GetCluster(clusterID)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyPeerCertificate(cluster, peerURL, peerCerts); err != nil {
+		return "", err
+	}
+	return td.Discover(pdName, clusterID, peerURL)
+}
+
+// verifyPeerCertificate checks that, when the cluster requires one, the
+// calling pod presented a client certificate whose SAN matches its own
+// advertise-peer host and whose issuer chains to a trust bundle the
+// cluster accepts: its own TrustBundle, which authorizes the local pods
+// that bootstrap this cluster's own quorum, or - when a PeerCluster is
+// configured - that PeerCluster's PeerTrustBundle, which authorizes a
+// genuine cross-cluster call made on behalf of the peer's own Discover
+// lookup. Either is sufficient; a PeerCluster only adds an additional
+// accepted issuer, it never replaces the cluster's own TrustBundle.
+func verifyPeerCertificate(cluster Cluster, peerURL *url.URL, peerCerts []*x509.Certificate) error {
+	if !cluster.RequireClientCert {
+		return nil
+	}
+	if len(peerCerts) == 0 {
+		return fmt.Errorf("discovery: client certificate required but none was presented")
+	}
+	cert := peerCerts[0]
+
+	host := peerURL.Hostname()
+	sanMatches := false
+	for _, name := range cert.DNSNames {
+		if name == host {
+			sanMatches = true
+			break
+		}
+	}
+	if !sanMatches {
+		return fmt.Errorf("discovery: certificate SAN does not match advertise-peer host %s", host)
+	}
+
+	if verifyAgainstTrustBundle(cert, peerCerts[1:], cluster.TrustBundle) == nil {
+		return nil
+	}
+	if cluster.PeerCluster != nil && len(cluster.PeerCluster.PeerTrustBundle) > 0 {
+		if verifyAgainstTrustBundle(cert, peerCerts[1:], cluster.PeerCluster.PeerTrustBundle) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("discovery: certificate does not chain to the cluster's trust bundle or its PeerCluster's PeerTrustBundle")
+}
+
+// verifyAgainstTrustBundle reports whether cert chains to a root in
+// trustBundle, treating any certificates in intermediates as additional
+// links the client sent along to complete that chain rather than being
+// signed directly by a root.
+func verifyAgainstTrustBundle(cert *x509.Certificate, intermediateCerts []*x509.Certificate, trustBundle []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(trustBundle) {
+		return fmt.Errorf("discovery: trust bundle contains no usable certificates")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, ic := range intermediateCerts {
+		intermediates.AddCert(ic)
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return err
+}
+
+// updateMemberIDs records the PD member ID reported for any peer we already
+// know about by name. If a known name now reports a different member ID
+// than we last recorded, the PD pod that held that name was recreated with
+// a new identity (e.g. its data directory was lost); its stale registration
+// is dropped so the next time that name registers, it's treated as new
+// rather than refreshed as if it were still the pod we expired.
+func updateMemberIDs(peers map[PDName]*peerInfo, membersInfo *pdapi.MembersInfo) {
+	for _, member := range membersInfo.Members {
+		peer, ok := peers[PDName(member.Name)]
+		if !ok {
+			continue
+		}
+		if peer.memberID != 0 && peer.memberID != member.MemberId {
+			klog.Warningf("discovery: %s reported PD member ID %d, previously %d; dropping its stale registration", member.Name, member.MemberId, peer.memberID)
+			delete(peers, PDName(member.Name))
+			continue
+		}
+		peer.memberID = member.MemberId
+		peer.lastSeen = time.Now()
+	}
+}
+
+// tokenInfo tracks the PD peers that have rendezvoused under a single
+// discoveryToken.
+type tokenInfo struct {
+	replicas int
+	peers    map[PDName]*peerInfo
+	// joined is set once the expected number of peers has checked in and
+	// the initial-cluster string has been handed out; latecomers after
+	// that are told to join instead of re-bootstrapping.
+	joined bool
+}
+
+// InitToken registers a discoveryToken along with the number of PD peers
+// expected to rendezvous under it. It is idempotent for a given token as
+// long as the replica count doesn't change underneath it.
+func (td *tidbDiscoveryMembers) InitToken(token string, replicas int) error {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	if ti, ok := td.tokens[token]; ok {
+		if ti.replicas != replicas {
+			return fmt.Errorf("discoveryToken %s was already initialized with %d replicas, got %d", token, ti.replicas, replicas)
+		}
+		return nil
+	}
+	td.tokens[token] = &tokenInfo{replicas: replicas, peers: map[PDName]*peerInfo{}}
+	return nil
+}
+
+// RegisterWithToken is an alternative to Discover for PD pods whose pod DNS
+// names aren't known in advance: instead of being grouped under
+// "<namespace>/<tcName>", pods rendezvous under a shared discoveryToken
+// (like etcd's original discovery service). It returns
+// "--initial-cluster=..." once all expected peers have checked in,
+// "--join=..." once that quorum has already bootstrapped, and an error
+// asking the caller to retry otherwise.
+func (td *tidbDiscoveryMembers) RegisterWithToken(token string, pdName PDName, peerURL *url.URL) (string, error) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	ti, ok := td.tokens[token]
+	if !ok {
+		return "", fmt.Errorf("discoveryToken %s is unknown, it must be initialized before peers can register", token)
+	}
+
+	if ti.joined {
+		return fmt.Sprintf("--join=%s", joinURLsFromPeers(ti.peers)), nil
+	}
+
+	if peer, exists := ti.peers[pdName]; exists {
+		peer.lastSeen = time.Now()
+	} else {
+		ti.peers[pdName] = &peerInfo{url: *peerURL, lastSeen: time.Now()}
+	}
+	if len(ti.peers) < ti.replicas {
+		return "", fmt.Errorf("waiting for all %d discoveryToken %s peers to register, have %d", ti.replicas, token, len(ti.peers))
+	}
+
+	ti.joined = true
+	members := make([]string, 0, len(ti.peers))
+	for name, peer := range ti.peers {
+		members = append(members, fmt.Sprintf("%s=%s", name, peer.url.String()))
+	}
+	sort.Strings(members)
+	return fmt.Sprintf("--initial-cluster=%s", strings.Join(members, ",")), nil
+}
+
+// joinURLsFromPeers renders a token's registered peer URLs as a sorted,
+// comma-separated list of PD client URLs suitable for a "--join" flag.
+func joinURLsFromPeers(peers map[PDName]*peerInfo) string {
+	urls := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		urls = append(urls, peerToClientURL(peer.url.Host))
+	}
+	sort.Strings(urls)
+	return strings.Join(urls, ",")
+}
+
+// peerToClientURL rewrites a PD peer URL's port from the peer port to the
+// client port, e.g. "demo-pd-0.demo-pd-peer.default.svc:2380" becomes
+// "demo-pd-0.demo-pd-peer.default.svc:2379".
+func peerToClientURL(peerURL string) string {
+	idx := strings.LastIndex(peerURL, ":")
+	if idx == -1 {
+		return peerURL
+	}
+	return peerURL[:idx] + ":" + pdClientPort
+}
+
+// RunPeerSweeper starts a background goroutine that periodically removes
+// registered peers that haven't refreshed within ttl, or whose explicit
+// expireAt has passed. This bounds the peers maps for TidbClusters and
+// discoveryTokens whose PD pods were scaled in without ever calling back
+// into Discover/RegisterWithToken to deregister themselves. A ttl of zero
+// or less means defaultPeerTTL. It returns once stopCh is closed.
+func (td *tidbDiscoveryMembers) RunPeerSweeper(ttl time.Duration, stopCh <-chan struct{}) {
+	if ttl <= 0 {
+		ttl = defaultPeerTTL
+	}
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			td.sweepExpiredPeers(ttl)
+		}
+	}
+}
+
+// sweepExpiredPeers drops expired entries from every tracked cluster and
+// discoveryToken.
+func (td *tidbDiscoveryMembers) sweepExpiredPeers(ttl time.Duration) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	now := time.Now()
+	for _, ci := range td.clusters {
+		for name, peer := range ci.peers {
+			if peer.expired(now, ttl) {
+				delete(ci.peers, name)
+			}
+		}
+	}
+	for _, ti := range td.tokens {
+		for name, peer := range ti.peers {
+			if peer.expired(now, ttl) {
+				delete(ti.peers, name)
+			}
+		}
+	}
+}
+
+// PeerStatus is the observability-friendly snapshot of a peerInfo exposed
+// through GetMembers.
+type PeerStatus struct {
+	MemberID uint64
+	LastSeen time.Time
+	ExpireAt time.Time
+}
+
+// GetMembers returns the peers currently registered for clusterKey (a
+// "<namespace>/<tcName>" clusterID or a discoveryToken), keyed by PDName.
+// It backs the discovery HTTP server's observability endpoint of the same
+// name.
+func (td *tidbDiscoveryMembers) GetMembers(clusterKey string) (map[PDName]PeerStatus, error) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	var peers map[PDName]*peerInfo
+	if ci, ok := td.clusters[clusterKey]; ok {
+		peers = ci.peers
+	} else if ti, ok := td.tokens[clusterKey]; ok {
+		peers = ti.peers
+	} else {
+		return nil, fmt.Errorf("no discovery state found for %s", clusterKey)
+	}
+
+	statuses := make(map[PDName]PeerStatus, len(peers))
+	for name, peer := range peers {
+		statuses[name] = PeerStatus{
+			MemberID: peer.memberID,
+			LastSeen: peer.lastSeen,
+			ExpireAt: peer.expireAt,
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/pingcap/tidb-operator/pkg/pdapi"
+)
+
+type testPeerDiscoverer struct {
+	discoverFn func(peer PeerCluster) ([]string, error)
+}
+
+func (t testPeerDiscoverer) DiscoverPeerMembers(peer PeerCluster) ([]string, error) {
+	return t.discoverFn(peer)
+}
+
+func TestParseK8sAddressFiveLabel(t *testing.T) {
+	g := NewGomegaWithT(t)
+	os.Setenv("MY_POD_NAMESPACE", "default")
+
+	pdName, clusterID, parsedURL, err := ParseK8sAddress("demo-pd-0.demo-pd-peer.default.svc.peer1:2380")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pdName).To(Equal(PDName("demo-pd-0")))
+	g.Expect(clusterID).To(Equal("default/demo"))
+	g.Expect(parsedURL.Hostname()).To(Equal("demo-pd-0.demo-pd-peer.default.svc.peer1"))
+}
+
+func TestDiscoverPeerCluster(t *testing.T) {
+	g := NewGomegaWithT(t)
+	os.Setenv("MY_POD_NAMESPACE", "default")
+
+	peerCluster := &PeerCluster{}
+	newClusterWithPeer := func() (Cluster, error) {
+		c := newCluster()
+		c.PeerCluster = peerCluster
+		return c, nil
+	}
+	parsedURL, err := ParseAddress("demo-pd-0.demo-pd-peer.default.svc:2380")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	t.Run("peer lookup succeeds, prefers the peer's quorum", func(t *testing.T) {
+		td := &tidbDiscoveryMembers{
+			tidbDiscovery: tidbDiscovery{clusters: map[string]*clusterInfo{}, tokens: map[string]*tokenInfo{}},
+			refresh:       testRefresher{getCluster: newClusterWithPeer},
+			peer: testPeerDiscoverer{discoverFn: func(peer PeerCluster) ([]string, error) {
+				return []string{"peer-pd-0.peer-pd-peer.default.svc:2379"}, nil
+			}},
+		}
+		s, err := td.Discover("demo-pd-0", "default/demo", parsedURL)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(s).To(Equal("--join=peer-pd-0.peer-pd-peer.default.svc:2379"))
+		g.Expect(td.clusters["default/demo"].peers).To(BeEmpty(), "the local bootstrap path should not have registered this pod")
+	})
+
+	t.Run("peer lookup errors, error is surfaced rather than swallowed", func(t *testing.T) {
+		td := &tidbDiscoveryMembers{
+			tidbDiscovery: tidbDiscovery{clusters: map[string]*clusterInfo{}, tokens: map[string]*tokenInfo{}},
+			refresh:       testRefresher{getCluster: newClusterWithPeer},
+			peer: testPeerDiscoverer{discoverFn: func(peer PeerCluster) ([]string, error) {
+				return nil, fmt.Errorf("peer discovery service unreachable")
+			}},
+		}
+		s, err := td.Discover("demo-pd-0", "default/demo", parsedURL)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("peer discovery service unreachable"))
+		g.Expect(s).To(BeEmpty())
+		g.Expect(td.clusters["default/demo"].peers).To(BeEmpty(), "a failed peer lookup must not silently fall through to local bootstrap")
+	})
+
+	t.Run("peer lookup returns no urls, falls back to local bootstrap", func(t *testing.T) {
+		td := &tidbDiscoveryMembers{
+			tidbDiscovery: tidbDiscovery{clusters: map[string]*clusterInfo{}, tokens: map[string]*tokenInfo{}},
+			refresh: testRefresher{
+				getCluster:   newClusterWithPeer,
+				getMembersFn: func() (*pdapi.MembersInfo, error) { return nil, fmt.Errorf("no pd members yet") },
+			},
+			peer: testPeerDiscoverer{discoverFn: func(peer PeerCluster) ([]string, error) {
+				return nil, nil
+			}},
+		}
+		s, err := td.Discover("demo-pd-0", "default/demo", parsedURL)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("no pd members yet"))
+		g.Expect(td.clusters["default/demo"].peers).To(HaveKey(PDName("demo-pd-0")))
+		g.Expect(s).To(BeEmpty())
+	})
+
+	t.Run("local quorum already complete takes precedence over the peer's", func(t *testing.T) {
+		td := &tidbDiscoveryMembers{
+			tidbDiscovery: tidbDiscovery{
+				clusters: map[string]*clusterInfo{
+					"default/demo": {
+						resourceVersion: "1",
+						peers: makePeers(map[string]struct{}{
+							"demo-pd-0": {},
+							"demo-pd-1": {},
+						}),
+					},
+				},
+				tokens: map[string]*tokenInfo{},
+			},
+			refresh: testRefresher{getCluster: newClusterWithPeer},
+			peer: testPeerDiscoverer{discoverFn: func(peer PeerCluster) ([]string, error) {
+				t.Fatal("peer discovery should not be consulted once the local quorum is complete")
+				return nil, nil
+			}},
+		}
+		thirdURL, err := ParseAddress("demo-pd-2.demo-pd-peer.default.svc:2380")
+		g.Expect(err).NotTo(HaveOccurred())
+
+		s, err := td.Discover("demo-pd-2", "default/demo", thirdURL)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(s).To(Equal("--initial-cluster=demo-pd-2=http://demo-pd-2.demo-pd-peer.default.svc:2380"))
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pingcap/tidb-operator/pkg/pdapi"
+)
+
+func TestUpdateMemberIDsDropsStaleIdentity(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	peers := map[PDName]*peerInfo{
+		"demo-pd-0": {memberID: 5},
+		"demo-pd-1": {},
+	}
+
+	updateMemberIDs(peers, &pdapi.MembersInfo{
+		Members: []*pdapi.Member{
+			{Name: "demo-pd-0", MemberId: 6},
+			{Name: "demo-pd-1", MemberId: 7},
+		},
+	})
+
+	// demo-pd-0 previously reported member ID 5 and now reports 6: the pod
+	// behind that name was recreated with a new identity, so its stale
+	// registration is dropped rather than refreshed.
+	g.Expect(peers).NotTo(HaveKey(PDName("demo-pd-0")))
+
+	// demo-pd-1 had no memberID recorded yet, so its first report is just
+	// learned, not treated as a change.
+	g.Expect(peers["demo-pd-1"].memberID).To(Equal(uint64(7)))
+}
+
+func TestPeerInfoExpired(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+
+	p := &peerInfo{lastSeen: now}
+	g.Expect(p.expired(now, time.Minute)).To(BeFalse())
+	g.Expect(p.expired(now.Add(2*time.Minute), time.Minute)).To(BeTrue())
+
+	p = &peerInfo{lastSeen: now, expireAt: now.Add(-time.Second)}
+	g.Expect(p.expired(now, time.Minute)).To(BeTrue(), "an explicit expireAt in the past always counts as expired")
+}
+
+func TestSweepExpiredPeers(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+
+	td := &tidbDiscoveryMembers{
+		tidbDiscovery: tidbDiscovery{
+			clusters: map[string]*clusterInfo{
+				"default/demo": {
+					peers: map[PDName]*peerInfo{
+						"demo-pd-0": {lastSeen: now},
+						"demo-pd-1": {lastSeen: now.Add(-time.Hour)},
+					},
+				},
+			},
+			tokens: map[string]*tokenInfo{
+				"tok1": {
+					peers: map[PDName]*peerInfo{
+						"demo-pd-2": {lastSeen: now.Add(-time.Hour)},
+					},
+				},
+			},
+		},
+	}
+
+	td.sweepExpiredPeers(time.Minute)
+
+	g.Expect(td.clusters["default/demo"].peers).To(HaveKey(PDName("demo-pd-0")))
+	g.Expect(td.clusters["default/demo"].peers).NotTo(HaveKey(PDName("demo-pd-1")))
+	g.Expect(td.tokens["tok1"].peers).To(BeEmpty())
+}
+
+func TestRunPeerSweeper(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	td := &tidbDiscoveryMembers{
+		tidbDiscovery: tidbDiscovery{
+			clusters: map[string]*clusterInfo{
+				"default/demo": {
+					peers: map[PDName]*peerInfo{
+						"demo-pd-0": {lastSeen: time.Now().Add(-time.Hour)},
+					},
+				},
+			},
+			tokens: map[string]*tokenInfo{},
+		},
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		td.RunPeerSweeper(10*time.Millisecond, stopCh)
+		close(done)
+	}()
+
+	g.Eventually(func() int {
+		td.lock.Lock()
+		defer td.lock.Unlock()
+		return len(td.clusters["default/demo"].peers)
+	}, time.Second, 10*time.Millisecond).Should(BeZero())
+
+	close(stopCh)
+	g.Eventually(done, time.Second).Should(BeClosed())
+}
+
+func TestGetMembers(t *testing.T) {
+	g := NewGomegaWithT(t)
+	now := time.Now()
+
+	td := &tidbDiscoveryMembers{
+		tidbDiscovery: tidbDiscovery{
+			clusters: map[string]*clusterInfo{
+				"default/demo": {
+					peers: map[PDName]*peerInfo{
+						"demo-pd-0": {memberID: 1, lastSeen: now},
+					},
+				},
+			},
+			tokens: map[string]*tokenInfo{
+				"tok1": {
+					peers: map[PDName]*peerInfo{
+						"demo-pd-1": {memberID: 2, lastSeen: now},
+					},
+				},
+			},
+		},
+	}
+
+	_, err := td.GetMembers("default/unknown")
+	g.Expect(err).To(HaveOccurred())
+
+	statuses, err := td.GetMembers("default/demo")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(statuses).To(HaveKey(PDName("demo-pd-0")))
+	g.Expect(statuses["demo-pd-0"].MemberID).To(Equal(uint64(1)))
+
+	statuses, err = td.GetMembers("tok1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(statuses).To(HaveKey(PDName("demo-pd-1")))
+}
@@ -15,13 +15,11 @@ package discovery
 
 import (
 	"fmt"
-	"net/url"
 	"os"
 	"strings"
 	"testing"
 
 	. "github.com/onsi/gomega"
-	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/tidb-operator/pkg/pdapi"
 )
 
@@ -300,7 +298,7 @@ func TestDiscoveryDiscovery(t *testing.T) {
 			cFn:  newClusterOk,
 			getMembersFn: func() (*pdapi.MembersInfo, error) {
 				return &pdapi.MembersInfo{
-					Members: []*pdpb.Member{
+					Members: []*pdapi.Member{
 						{
 							PeerUrls: []string{"demo-pd-2.demo-pd-peer.default.svc:2380"},
 						},
@@ -331,7 +329,7 @@ func TestDiscoveryDiscovery(t *testing.T) {
 			cFn:  newClusterOk,
 			getMembersFn: func() (*pdapi.MembersInfo, error) {
 				return &pdapi.MembersInfo{
-					Members: []*pdpb.Member{
+					Members: []*pdapi.Member{
 						{
 							PeerUrls: []string{"demo-pd-0.demo-pd-peer.default.svc:2380"},
 						},
@@ -367,7 +365,7 @@ func TestDiscoveryDiscovery(t *testing.T) {
 			},
 			getMembersFn: func() (*pdapi.MembersInfo, error) {
 				return &pdapi.MembersInfo{
-					Members: []*pdpb.Member{
+					Members: []*pdapi.Member{
 						{
 							PeerUrls: []string{"demo-pd-0.demo-pd-peer.default.svc:2380"},
 						},
@@ -404,7 +402,7 @@ func TestDiscoveryDiscovery(t *testing.T) {
 			},
 			getMembersFn: func() (*pdapi.MembersInfo, error) {
 				return &pdapi.MembersInfo{
-					Members: []*pdpb.Member{
+					Members: []*pdapi.Member{
 						{
 							PeerUrls: []string{"demo-pd-0.demo-pd-peer.default.svc:2380"},
 						},
@@ -447,10 +445,10 @@ func TestDiscoveryDiscovery(t *testing.T) {
 	}
 }
 
-func makePeers(input map[string]struct{}) map[PDName]url.URL {
-	peers := make(map[PDName]url.URL)
+func makePeers(input map[string]struct{}) map[PDName]*peerInfo {
+	peers := make(map[PDName]*peerInfo)
 	for k := range input {
-		peers[PDName(k)] = url.URL{}
+		peers[PDName(k)] = &peerInfo{}
 	}
 	return peers
 }
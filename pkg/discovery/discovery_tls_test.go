@@ -0,0 +1,195 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/pingcap/tidb-operator/pkg/pdapi"
+)
+
+// testCA generates a throwaway self-signed CA for exercising trust-bundle
+// verification; it returns the parsed cert, its key, and its PEM encoding.
+func testCA(g *GomegaWithT, cn string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// testIntermediateCA generates a throwaway intermediate CA signed by
+// ca/caKey, for exercising chain-building through Intermediates rather than
+// a leaf signed directly by a trust-bundle root.
+func testIntermediateCA(g *GomegaWithT, ca *x509.Certificate, caKey *ecdsa.PrivateKey, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return cert, key
+}
+
+// testLeafCert generates a throwaway client certificate for dnsName signed
+// by ca/caKey.
+func testLeafCert(g *GomegaWithT, ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+		DNSNames:     []string{dnsName},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func TestDiscoverTLS(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	ca, caKey, caPEM := testCA(g, "test-ca")
+	otherCA, otherCAKey, otherCAPEM := testCA(g, "other-ca")
+
+	peerURL, err := ParseAddress("demo-pd-0.demo-pd-peer.default.svc:2380")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	newTD := func(cluster Cluster) *tidbDiscoveryMembers {
+		return &tidbDiscoveryMembers{
+			tidbDiscovery: tidbDiscovery{clusters: map[string]*clusterInfo{}, tokens: map[string]*tokenInfo{}},
+			refresh: testRefresher{
+				getCluster:   func() (Cluster, error) { return cluster, nil },
+				getMembersFn: func() (*pdapi.MembersInfo, error) { return nil, fmt.Errorf("no pd members yet") },
+			},
+		}
+	}
+
+	t.Run("TLS enabled, no cert presented", func(t *testing.T) {
+		td := newTD(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM})
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, nil)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("client certificate required"))
+	})
+
+	t.Run("TLS enabled, wrong SAN", func(t *testing.T) {
+		td := newTD(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM})
+		wrongCert := testLeafCert(g, ca, caKey, "demo-pd-1.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{wrongCert})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("SAN"))
+	})
+
+	t.Run("TLS enabled, untrusted issuer", func(t *testing.T) {
+		td := newTD(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM})
+		cert := testLeafCert(g, otherCA, otherCAKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("trust bundle"))
+	})
+
+	t.Run("TLS enabled, valid cert accepted", func(t *testing.T) {
+		td := newTD(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM})
+		cert := testLeafCert(g, ca, caKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert})
+		// The certificate is accepted; Discover still fails because the
+		// test refresher reports no PD members yet, which is unrelated to TLS.
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).NotTo(ContainSubstring("certificate"))
+	})
+
+	t.Run("TLS enabled, PeerCluster configured, local pod still verified against the cluster's own TrustBundle", func(t *testing.T) {
+		td := newTD(Cluster{
+			Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM,
+			PeerCluster: &PeerCluster{PeerTrustBundle: otherCAPEM},
+		})
+		cert := testLeafCert(g, ca, caKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert})
+		// A PeerCluster only adds its PeerTrustBundle as an accepted
+		// issuer; a local pod's cert that chains to the cluster's own
+		// TrustBundle is still accepted.
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).NotTo(ContainSubstring("certificate"))
+	})
+
+	t.Run("TLS enabled, PeerCluster configured, peer cluster's cert accepted via PeerTrustBundle", func(t *testing.T) {
+		td := newTD(Cluster{
+			Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM,
+			PeerCluster: &PeerCluster{PeerTrustBundle: otherCAPEM},
+		})
+		cert := testLeafCert(g, otherCA, otherCAKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert})
+		// A genuine cross-cluster call, signed by the peer's own
+		// PeerTrustBundle issuer rather than this cluster's TrustBundle,
+		// is also accepted.
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).NotTo(ContainSubstring("certificate"))
+	})
+
+	t.Run("TLS enabled, PeerCluster configured, cert from neither bundle rejected", func(t *testing.T) {
+		thirdCA, thirdCAKey, _ := testCA(g, "third-ca")
+		td := newTD(Cluster{
+			Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM,
+			PeerCluster: &PeerCluster{PeerTrustBundle: otherCAPEM},
+		})
+		cert := testLeafCert(g, thirdCA, thirdCAKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).To(ContainSubstring("trust bundle"))
+	})
+
+	t.Run("TLS enabled, leaf signed by an intermediate chains to the root", func(t *testing.T) {
+		td := newTD(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1", RequireClientCert: true, TrustBundle: caPEM})
+		intermediate, intermediateKey := testIntermediateCA(g, ca, caKey, "test-intermediate")
+		cert := testLeafCert(g, intermediate, intermediateKey, "demo-pd-0.demo-pd-peer.default.svc")
+		_, err := td.DiscoverTLS("demo-pd-0", "default/demo", peerURL, []*x509.Certificate{cert, intermediate})
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(err.Error()).NotTo(ContainSubstring("certificate"))
+	})
+}
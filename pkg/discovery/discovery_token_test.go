@@ -0,0 +1,64 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"net/url"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestTidbDiscoveryMembersRegisterWithToken(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	td := &tidbDiscoveryMembers{
+		tidbDiscovery: tidbDiscovery{
+			clusters: map[string]*clusterInfo{},
+			tokens:   map[string]*tokenInfo{},
+		},
+	}
+
+	_, err := td.RegisterWithToken("unknown-token", "pd-0", mustParseAddress(g, "pd-0.peer:2380"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("is unknown"))
+
+	g.Expect(td.InitToken("tok1", 3)).To(Succeed())
+	g.Expect(td.InitToken("tok1", 3)).To(Succeed(), "InitToken should be idempotent")
+	err = td.InitToken("tok1", 4)
+	g.Expect(err).To(HaveOccurred(), "changing the replica count of an initialized token should error")
+
+	s, err := td.RegisterWithToken("tok1", "pd-0", mustParseAddress(g, "pd-0.peer:2380"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(s).To(BeEmpty())
+
+	s, err = td.RegisterWithToken("tok1", "pd-1", mustParseAddress(g, "pd-1.peer:2380"))
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(s).To(BeEmpty())
+
+	s, err = td.RegisterWithToken("tok1", "pd-2", mustParseAddress(g, "pd-2.peer:2380"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s).To(Equal("--initial-cluster=pd-0=http://pd-0.peer:2380,pd-1=http://pd-1.peer:2380,pd-2=http://pd-2.peer:2380"))
+
+	// A latecomer after bootstrap has completed is told to join instead.
+	s, err = td.RegisterWithToken("tok1", "pd-3", mustParseAddress(g, "pd-3.peer:2380"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(s).To(Equal("--join=pd-0.peer:2379,pd-1.peer:2379,pd-2.peer:2379"))
+}
+
+func mustParseAddress(g *GomegaWithT, addr string) *url.URL {
+	u, err := ParseAddress(addr)
+	g.Expect(err).NotTo(HaveOccurred())
+	return u
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package types holds the discovery domain types - Cluster, PeerCluster,
+// PDName and URLs - apart from the tidbDiscovery server that depends on
+// them, so that external tools (a tkctl subcommand, a validating webhook)
+// can parse and validate PD URL strings without importing the discovery
+// server. The pdapi package does not import this package; its Member type
+// keeps PeerUrls as a plain string slice.
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// PDName is the name (and pod name) a PD member registers itself under,
+// e.g. "demo-pd-0".
+type PDName string
+
+// URLs is a validated, non-empty list of PD URLs, such as a member's
+// PeerUrls or ClientUrls. It round-trips through JSON as a plain string
+// slice, matching the on-disk/CRD form.
+type URLs struct {
+	urls []url.URL
+}
+
+// NewURLs parses raw into a URLs, rejecting an empty list or any entry
+// that doesn't parse as a URL.
+func NewURLs(raw []string) (URLs, error) {
+	if len(raw) == 0 {
+		return URLs{}, fmt.Errorf("URLs must not be empty")
+	}
+	urls := make([]url.URL, 0, len(raw))
+	for _, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			return URLs{}, fmt.Errorf("invalid URL %q: %v", r, err)
+		}
+		urls = append(urls, *u)
+	}
+	return URLs{urls: urls}, nil
+}
+
+// StringSlice returns the URLs in the form NewURLs accepts.
+func (u URLs) StringSlice() []string {
+	out := make([]string, 0, len(u.urls))
+	for _, parsed := range u.urls {
+		out = append(out, parsed.String())
+	}
+	return out
+}
+
+// String renders the URLs as a comma-separated list.
+func (u URLs) String() string {
+	return strings.Join(u.StringSlice(), ",")
+}
+
+// MarshalJSON implements json.Marshaler, encoding URLs as a string slice.
+func (u URLs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.StringSlice())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, validating each entry the same
+// way NewURLs does.
+func (u *URLs) UnmarshalJSON(data []byte) error {
+	var raw []string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	parsed, err := NewURLs(raw)
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+// PeerCluster describes a remote TidbCluster's discovery service that PD
+// members of a Cluster may peer with across a Kubernetes cluster boundary,
+// letting a single PD Raft group stretch across clusters.
+type PeerCluster struct {
+	// DiscoveryURLs are the discovery service endpoints of the peer
+	// TidbCluster, e.g. "https://demo-discovery.default.svc.peer1:10261".
+	DiscoveryURLs URLs `json:"discoveryURLs"`
+	// PeerTrustBundle is the PEM-encoded CA set for mutual authentication
+	// with the peer cluster's discovery service: it authenticates that
+	// service to whatever peerDiscoverer dials DiscoveryURLs on our
+	// behalf, so that cluster's reported quorum can be trusted before we
+	// tell a local pod to join it, and it authorizes that service's own
+	// calls back into our DiscoverTLS, alongside our own TrustBundle, when
+	// it looks up our quorum on a peer's behalf.
+	PeerTrustBundle []byte `json:"peerTrustBundle,omitempty"`
+}
+
+// Cluster is the subset of TidbCluster state the discovery service needs to
+// decide whether a PD member should bootstrap, wait, or join.
+type Cluster struct {
+	Replicas        int    `json:"replicas"`
+	Scheme          string `json:"scheme"`
+	ResourceVersion string `json:"resourceVersion"`
+	// PeerCluster, when set, means this cluster's PD quorum may already be
+	// established in a peer Kubernetes cluster.
+	PeerCluster *PeerCluster `json:"peerCluster,omitempty"`
+	// TrustBundle is the PEM-encoded CA set that a calling pod's client
+	// certificate must chain to when RequireClientCert is set, sourced
+	// from the TidbCluster's Spec.TLSCluster secret.
+	TrustBundle []byte `json:"trustBundle,omitempty"`
+	// RequireClientCert, when set, means DiscoverTLS authenticates the
+	// calling pod's client certificate before handing out bootstrap
+	// information; plain Discover does not check it.
+	RequireClientCert bool `json:"requireClientCert,omitempty"`
+}
+
+// NewCluster validates and constructs a Cluster. trustBundle and
+// requireClientCert may be zero-valued for a cluster that doesn't
+// authenticate Discover callers; requireClientCert without a trustBundle
+// to verify callers against is rejected.
+func NewCluster(replicas int, scheme, resourceVersion string, peer *PeerCluster, trustBundle []byte, requireClientCert bool) (Cluster, error) {
+	if replicas <= 0 {
+		return Cluster{}, fmt.Errorf("replicas must be positive, got %d", replicas)
+	}
+	if scheme != "http" && scheme != "https" {
+		return Cluster{}, fmt.Errorf("scheme must be http or https, got %q", scheme)
+	}
+	if requireClientCert && len(trustBundle) == 0 {
+		return Cluster{}, fmt.Errorf("requireClientCert is set but trustBundle is empty")
+	}
+	return Cluster{
+		Replicas:          replicas,
+		Scheme:            scheme,
+		ResourceVersion:   resourceVersion,
+		PeerCluster:       peer,
+		TrustBundle:       trustBundle,
+		RequireClientCert: requireClientCert,
+	}, nil
+}
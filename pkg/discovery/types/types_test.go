@@ -0,0 +1,72 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestNewURLs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := NewURLs(nil)
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = NewURLs([]string{":::not-a-url"})
+	g.Expect(err).To(HaveOccurred())
+
+	urls, err := NewURLs([]string{"http://demo-pd-0.demo-pd-peer.default.svc:2379"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(urls.StringSlice()).To(Equal([]string{"http://demo-pd-0.demo-pd-peer.default.svc:2379"}))
+}
+
+func TestURLsJSONRoundTrip(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	urls, err := NewURLs([]string{"http://demo-pd-0.demo-pd-peer.default.svc:2379", "http://demo-pd-1.demo-pd-peer.default.svc:2379"})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	data, err := json.Marshal(urls)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(data)).To(Equal(`["http://demo-pd-0.demo-pd-peer.default.svc:2379","http://demo-pd-1.demo-pd-peer.default.svc:2379"]`))
+
+	var roundTripped URLs
+	g.Expect(json.Unmarshal(data, &roundTripped)).To(Succeed())
+	g.Expect(roundTripped).To(Equal(urls))
+}
+
+func TestNewCluster(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	_, err := NewCluster(0, "http", "1", nil, nil, false)
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = NewCluster(3, "ftp", "1", nil, nil, false)
+	g.Expect(err).To(HaveOccurred())
+
+	_, err = NewCluster(3, "http", "1", nil, nil, true)
+	g.Expect(err).To(HaveOccurred(), "requireClientCert without a trustBundle should be rejected")
+
+	c, err := NewCluster(3, "http", "1", nil, nil, false)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c).To(Equal(Cluster{Replicas: 3, Scheme: "http", ResourceVersion: "1"}))
+
+	trustBundle := []byte("-----BEGIN CERTIFICATE-----\n...\n-----END CERTIFICATE-----\n")
+	c, err = NewCluster(3, "https", "1", nil, trustBundle, true)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(c).To(Equal(Cluster{Replicas: 3, Scheme: "https", ResourceVersion: "1", TrustBundle: trustBundle, RequireClientCert: true}))
+}
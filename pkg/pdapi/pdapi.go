@@ -0,0 +1,32 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pdapi holds the PD API types, such as the membership that PD
+// reports, that the discovery service consumes.
+package pdapi
+
+// Member is the subset of PD's pdpb.Member fields that this package's
+// callers need. We define it locally instead of depending on
+// github.com/pingcap/kvproto: that module pulls in PD's full gRPC/protobuf
+// toolchain for three simple fields.
+type Member struct {
+	Name     string   `json:"name,omitempty"`
+	MemberId uint64   `json:"member_id,omitempty"`
+	PeerUrls []string `json:"peer_urls,omitempty"`
+}
+
+// MembersInfo is the result of a PD GetMembers call.
+type MembersInfo struct {
+	Members []*Member `json:"members,omitempty"`
+	Leader  *Member   `json:"leader,omitempty"`
+}